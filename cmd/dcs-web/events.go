@@ -0,0 +1,283 @@
+// vim:ts=4:sw=4:noexpandtab
+// events streams partial results for a running query over Server-Sent
+// Events, so that the placeholder page can fill in hits as they arrive
+// instead of waiting for the full backend pass and then meta-refreshing.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var pumpIdleTTL = flag.Duration("events_pump_ttl", 10*time.Minute,
+	"How long ensurePump polls a queryid that never completes before giving "+
+		"up and tearing down its poller, bounding how long an attacker can "+
+		"keep a per-queryid goroutine alive by naming an id nobody started")
+
+// subscription delivers published results to a single SSE client via an
+// internal unbounded queue fed by a pump goroutine, so that a slow
+// consumer never causes publish to silently drop results the way a
+// fixed-size buffered channel would.
+type subscription struct {
+	in   chan Result
+	out  chan Result
+	stop chan struct{}
+}
+
+func newSubscription() *subscription {
+	s := &subscription{
+		in:   make(chan Result),
+		out:  make(chan Result),
+		stop: make(chan struct{}),
+	}
+	go s.pump()
+	return s
+}
+
+// pump buffers results sent on s.in (without bound) and relays them to s.out
+// in order, so sending never blocks the broadcaster on a slow reader of
+// s.out. Closing s.stop ends the pump and closes s.out without draining any
+// still-queued results, signalling "no more results" to the reader exactly
+// like the old close-on-done channel did.
+func (s *subscription) pump() {
+	var queue []Result
+	for {
+		if len(queue) == 0 {
+			select {
+			case r := <-s.in:
+				queue = append(queue, r)
+			case <-s.stop:
+				close(s.out)
+				return
+			}
+		} else {
+			select {
+			case r := <-s.in:
+				queue = append(queue, r)
+			case s.out <- queue[0]:
+				queue = queue[1:]
+			case <-s.stop:
+				close(s.out)
+				return
+			}
+		}
+	}
+}
+
+func (s *subscription) send(result Result) {
+	s.in <- result
+}
+
+func (s *subscription) close() {
+	close(s.stop)
+}
+
+// resultBroadcaster fans out Results for a queryid to every subscriber
+// currently watching it. ensurePump calls publish as the query executor
+// writes result pages and markDone once the query completes.
+type resultBroadcaster struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscription]bool
+	done map[string]bool
+}
+
+var broadcaster = &resultBroadcaster{
+	subs: make(map[string]map[*subscription]bool),
+	done: make(map[string]bool),
+}
+
+// subscribe registers a new listener for queryid, returning the
+// subscription to read results from (via its out channel) and whether the
+// query has already finished.
+func (b *resultBroadcaster) subscribe(queryid string) (*subscription, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := newSubscription()
+	if b.subs[queryid] == nil {
+		b.subs[queryid] = make(map[*subscription]bool)
+	}
+	b.subs[queryid][sub] = true
+	return sub, b.done[queryid]
+}
+
+func (b *resultBroadcaster) unsubscribe(queryid string, sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[queryid][sub]; !ok {
+		// Already removed and closed by markDone.
+		return
+	}
+	delete(b.subs[queryid], sub)
+	if len(b.subs[queryid]) == 0 {
+		delete(b.subs, queryid)
+	}
+	sub.close()
+}
+
+// publish fans a single freshly-found result out to every subscriber of
+// queryid. Each subscription buffers internally, so a slow subscriber
+// cannot cause a result to be dropped for anyone.
+func (b *resultBroadcaster) publish(queryid string, result Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[queryid] {
+		sub.send(result)
+	}
+}
+
+// markDone closes out queryid: every current subscriber's out channel is
+// closed, signalling that no more results will arrive, and any future
+// subscriber is told via the done return value of subscribe.
+func (b *resultBroadcaster) markDone(queryid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done[queryid] = true
+	for sub := range b.subs[queryid] {
+		sub.close()
+	}
+	delete(b.subs, queryid)
+}
+
+// forget drops all broadcaster bookkeeping for queryid. It is called by the
+// result janitor (see resultcache.go) once a query's on-disk directory has
+// been reaped, so that b.done does not grow by one entry per query forever.
+func (b *resultBroadcaster) forget(queryid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.done, queryid)
+	delete(b.subs, queryid)
+}
+
+var (
+	pumpsMu sync.Mutex
+	pumps   = make(map[string]bool)
+)
+
+// ensurePump starts, at most once per queryid, a goroutine that bridges the
+// (poll-based) query executor into the broadcaster. It publishes each
+// result page as soon as state[queryid].resultPages grows to cover it,
+// rather than waiting for the whole backend pass to finish, so that
+// subscribers see hits arrive incrementally while the query is still
+// running. Once the query executor gains a native chan Result of its own,
+// it should publish/markDone directly from there instead of going through
+// this poller.
+//
+// queryid does not have to name a query anyone ever started (state[queryid]
+// is simply the zero value until ensureQueryStarted runs), so the pump gives
+// up and tears itself down after -events_pump_ttl instead of polling
+// forever: without that bound, every distinct never-started queryid an
+// attacker requests via Events would leak one permanently-running goroutine.
+func ensurePump(queryid string) {
+	pumpsMu.Lock()
+	if pumps[queryid] {
+		pumpsMu.Unlock()
+		return
+	}
+	pumps[queryid] = true
+	pumpsMu.Unlock()
+
+	go func() {
+		published := 0
+		deadline := time.Now().Add(*pumpIdleTTL)
+		for {
+			completed := queryCompleted(queryid)
+			resultPages := state[queryid].resultPages
+			for published < resultPages {
+				results, err := loadResultsPage(queryid, published)
+				if err != nil {
+					// Transient read race with the backend still writing
+					// this page; retry it on the next poll iteration
+					// instead of skipping it forever.
+					break
+				}
+				for _, result := range results {
+					broadcaster.publish(queryid, result)
+				}
+				published++
+			}
+			if completed {
+				break
+			}
+			if time.Now().After(deadline) {
+				log.Printf("ensurePump(%q): giving up after %s with no completion", queryid, *pumpIdleTTL)
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		broadcaster.markDone(queryid)
+
+		pumpsMu.Lock()
+		delete(pumps, queryid)
+		pumpsMu.Unlock()
+	}()
+}
+
+// Events streams partial results for queryid= as Server-Sent Events. For
+// no-JS clients, the placeholder template keeps its meta-refresh fallback;
+// its JS shim uses this endpoint to progressively fill the results table
+// instead of reloading the whole page.
+//
+// Like Search, it is gated by ipLimiter so a client cannot spin up an
+// unbounded number of ensurePump goroutines by requesting distinct queryid
+// values it never ran a real query for.
+func Events(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form data", http.StatusInternalServerError)
+		return
+	}
+
+	queryid := r.Form.Get("queryid")
+	if queryid == "" {
+		http.Error(w, "Missing queryid parameter", http.StatusBadRequest)
+		return
+	}
+
+	if !ipLimiter.allow(clientIP(r)) {
+		tooManyRequests(w, "Rate limit exceeded, please slow down")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ensurePump(queryid)
+	sub, done := broadcaster.subscribe(queryid)
+	defer broadcaster.unsubscribe(queryid, sub)
+
+	if done || queryCompleted(queryid) {
+		fmt.Fprintf(w, "event: done\ndata: {}\n\n")
+		flusher.Flush()
+		return
+	}
+
+	for {
+		select {
+		case result, ok := <-sub.out:
+			if !ok {
+				fmt.Fprintf(w, "event: done\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			payload, err := json.Marshal(buildJSONResults([]Result{result})[0])
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: result\ndata: %s\n\n", payload)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
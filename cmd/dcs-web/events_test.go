@@ -0,0 +1,108 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscriptionBuffersBeyondOldChannelCap(t *testing.T) {
+	sub := newSubscription()
+	defer sub.close()
+
+	// The old implementation used a 16-slot buffered channel and dropped
+	// anything beyond that for a reader that hadn't caught up yet. Sending
+	// well past that before ever reading out must not drop anything.
+	const n = 100
+	for i := 0; i < n; i++ {
+		sub.send(Result{Line: i})
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case result := <-sub.out:
+			if result.Line != i {
+				t.Fatalf("out[%d].Line = %d, want %d", i, result.Line, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for result %d", i)
+		}
+	}
+}
+
+func TestSubscriptionCloseSignalsDone(t *testing.T) {
+	sub := newSubscription()
+	sub.close()
+
+	select {
+	case _, ok := <-sub.out:
+		if ok {
+			t.Fatalf("expected out to be closed, got a value instead")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for out to close")
+	}
+}
+
+func TestResultBroadcasterPublishSubscribe(t *testing.T) {
+	b := &resultBroadcaster{
+		subs: make(map[string]map[*subscription]bool),
+		done: make(map[string]bool),
+	}
+
+	sub, done := b.subscribe("q1")
+	if done {
+		t.Fatalf("a brand-new queryid should not be marked done")
+	}
+
+	b.publish("q1", Result{Line: 42})
+	select {
+	case result := <-sub.out:
+		if result.Line != 42 {
+			t.Errorf("result.Line = %d, want 42", result.Line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for published result")
+	}
+
+	b.markDone("q1")
+	select {
+	case _, ok := <-sub.out:
+		if ok {
+			t.Errorf("expected out to close after markDone")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for out to close after markDone")
+	}
+
+	if _, done := b.subscribe("q1"); !done {
+		t.Errorf("a new subscriber after markDone should see done=true")
+	}
+}
+
+func TestResultBroadcasterUnsubscribeAfterMarkDone(t *testing.T) {
+	b := &resultBroadcaster{
+		subs: make(map[string]map[*subscription]bool),
+		done: make(map[string]bool),
+	}
+
+	sub, _ := b.subscribe("q1")
+	b.markDone("q1")
+	// Must not double-close sub's stop channel (markDone already closed it).
+	b.unsubscribe("q1", sub)
+}
+
+func TestResultBroadcasterForget(t *testing.T) {
+	b := &resultBroadcaster{
+		subs: make(map[string]map[*subscription]bool),
+		done: make(map[string]bool),
+	}
+
+	b.subscribe("q1")
+	b.markDone("q1")
+	b.forget("q1")
+
+	if _, done := b.subscribe("q1"); done {
+		t.Errorf("after forget, q1 should be treated as a fresh query, not done")
+	}
+}
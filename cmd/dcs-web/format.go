@@ -0,0 +1,170 @@
+// vim:ts=4:sw=4:noexpandtab
+// Machine-readable representations of search results (JSON, Atom) plus the
+// OpenSearch description document that lets browsers and editor plugins
+// discover them.
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// determineFormat content-negotiates the representation for the Search
+// handler. The format= parameter takes precedence over the Accept header;
+// html is the default so that existing links keep working unchanged.
+func determineFormat(r *http.Request) string {
+	switch r.Form.Get("format") {
+	case "json":
+		return "json"
+	case "atom":
+		return "atom"
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/atom+xml"):
+		return "atom"
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	}
+	return "html"
+}
+
+// jsonResult is the JSON representation of a single match, mirroring
+// HalfRenderedResult but keeping the context lines as an unescaped array
+// instead of joining them into a block of HTML.
+type jsonResult struct {
+	Path          string   `json:"Path"`
+	Line          int      `json:"Line"`
+	PathRank      float32  `json:"PathRank"`
+	Ranking       float32  `json:"Ranking"`
+	SourcePackage string   `json:"SourcePackage"`
+	RelativePath  string   `json:"RelativePath"`
+	Context       []string `json:"Context"`
+}
+
+// jsonSearchResponse is the top-level object served for format=json.
+type jsonSearchResponse struct {
+	Query       string       `json:"query"`
+	QueryId     string       `json:"queryid"`
+	Complete    bool         `json:"complete"`
+	Page        int          `json:"page"`
+	ResultPages int          `json:"resultPages"`
+	Results     []jsonResult `json:"results"`
+}
+
+// buildJSONResults converts decoded disk results into their JSON
+// representation, keeping the 5-line context around the match as a plain
+// string array rather than HTML-joining it.
+func buildJSONResults(results []Result) []jsonResult {
+	converted := make([]jsonResult, len(results))
+	for idx, result := range results {
+		sourcePackage, relativePath := splitPath(result.Path)
+		converted[idx] = jsonResult{
+			Path:          result.Path,
+			Line:          result.Line,
+			PathRank:      result.PathRank,
+			Ranking:       result.Ranking,
+			SourcePackage: sourcePackage,
+			RelativePath:  relativePath,
+			Context: []string{
+				result.Ctxp2,
+				result.Ctxp1,
+				result.Context,
+				result.Ctxn1,
+				result.Ctxn2,
+			},
+		}
+	}
+	return converted
+}
+
+// atomFeed and atomEntry model just enough of RFC 4287 to publish search
+// results as an Atom feed for feed readers and CI tools.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string `xml:"title"`
+	ID      string `xml:"id"`
+	Updated string `xml:"updated"`
+	Summary string `xml:"summary"`
+}
+
+// buildAtomFeed renders results as an Atom feed, one entry per match.
+func buildAtomFeed(q, queryid string, results []Result) atomFeed {
+	now := time.Now().UTC().Format(time.RFC3339)
+	feed := atomFeed{
+		Title:   "Debian Code Search: " + q,
+		ID:      "urn:dcs:query:" + queryid,
+		Updated: now,
+		Entries: make([]atomEntry, len(results)),
+	}
+	for idx, result := range results {
+		feed.Entries[idx] = atomEntry{
+			Title:   result.Path,
+			ID:      "urn:dcs:query:" + queryid + ":" + result.Path,
+			Updated: now,
+			Summary: result.Context,
+		}
+	}
+	return feed
+}
+
+// writeFormattedResults serves results as format ("json" or "atom") instead
+// of rendering an HTML template. It returns false (and writes nothing) for
+// any other format so that callers fall back to normal HTML rendering.
+func writeFormattedResults(w http.ResponseWriter, format, q, queryid string, page, resultPages int, complete bool, results []Result) bool {
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		response := jsonSearchResponse{
+			Query:       q,
+			QueryId:     queryid,
+			Complete:    complete,
+			Page:        page,
+			ResultPages: resultPages,
+			Results:     buildJSONResults(results),
+		}
+		json.NewEncoder(w).Encode(response)
+		return true
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		feed := buildAtomFeed(q, queryid, results)
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		encoder.Encode(feed)
+		return true
+	}
+	return false
+}
+
+// openSearchDescription is the static OpenSearch description document
+// advertised at /opensearch.xml, pointing clients back at /search.
+const openSearchDescription = `<?xml version="1.0" encoding="UTF-8"?>
+<OpenSearchDescription xmlns="http://a9.com/-/spec/opensearch/1.1/">
+  <ShortName>Debian Code Search</ShortName>
+  <Description>Search the full text of all packages in Debian</Description>
+  <InputEncoding>UTF-8</InputEncoding>
+  <Url type="text/html" template="/search?q={searchTerms}&amp;page={startPage?}" pageOffset="0"/>
+  <Url type="application/json" template="/search?q={searchTerms}&amp;page={startPage?}&amp;format=json" pageOffset="0"/>
+  <Url type="application/atom+xml" template="/search?q={searchTerms}&amp;page={startPage?}&amp;format=atom" pageOffset="0"/>
+</OpenSearchDescription>
+`
+
+// OpenSearchDescription serves the OpenSearch description document at
+// /opensearch.xml so that browsers and editor plugins can discover dcs as a
+// search provider.
+func OpenSearchDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml; charset=utf-8")
+	w.Write([]byte(openSearchDescription))
+}
@@ -0,0 +1,77 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestDetermineFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		accept string
+		want   string
+	}{
+		{"default is html", "", "", "html"},
+		{"format= takes precedence over Accept", "json", "application/atom+xml", "json"},
+		{"format=atom", "atom", "", "atom"},
+		{"unknown format= falls through to Accept", "xml", "application/json", "json"},
+		{"Accept: application/json", "", "application/json", "json"},
+		{"Accept: application/atom+xml", "", "application/atom+xml", "atom"},
+		{"Accept: text/html", "", "text/html", "html"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{}
+			if test.format != "" {
+				form.Set("format", test.format)
+			}
+			r := &http.Request{Form: form, Header: http.Header{}}
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			if got := determineFormat(r); got != test.want {
+				t.Errorf("determineFormat() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildJSONResults(t *testing.T) {
+	results := []Result{
+		{
+			Path:     "bash_5.1/configure.c",
+			Line:     42,
+			PathRank: 1.5,
+			Ranking:  2.5,
+			Ctxp2:    "before-before",
+			Ctxp1:    "before",
+			Context:  "match",
+			Ctxn1:    "after",
+			Ctxn2:    "after-after",
+		},
+	}
+
+	converted := buildJSONResults(results)
+	if len(converted) != 1 {
+		t.Fatalf("got %d results, want 1", len(converted))
+	}
+
+	got := converted[0]
+	if got.SourcePackage != "bash_5.1" || got.RelativePath != "/configure.c" {
+		t.Errorf("SourcePackage/RelativePath = %q/%q, want bash_5.1//configure.c", got.SourcePackage, got.RelativePath)
+	}
+	wantContext := []string{"before-before", "before", "match", "after", "after-after"}
+	if len(got.Context) != len(wantContext) {
+		t.Fatalf("got %d context lines, want %d", len(got.Context), len(wantContext))
+	}
+	for i, line := range wantContext {
+		if got.Context[i] != line {
+			t.Errorf("Context[%d] = %q, want %q", i, got.Context[i], line)
+		}
+	}
+}
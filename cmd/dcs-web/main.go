@@ -0,0 +1,24 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+var listenAddress = flag.String("listen_address", ":28080",
+	"Address (host:port) to listen on for HTTP requests")
+
+func main() {
+	flag.Parse()
+
+	startResultJanitor(*queryResultsPath)
+	startRateLimiterJanitor()
+
+	http.HandleFunc("/search", Search)
+	http.HandleFunc("/opensearch.xml", OpenSearchDescription)
+	http.HandleFunc("/events", Events)
+
+	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+}
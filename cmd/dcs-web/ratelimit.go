@@ -0,0 +1,201 @@
+// vim:ts=4:sw=4:noexpandtab
+// ratelimit protects Search against an unbounded number of backend queries:
+// a token-bucket limiter per client address, plus a global cap on the
+// number of queries that may be in flight at once.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	perIPQPS = flag.Float64("per_ip_qps", 1.0,
+		"Maximum number of /search and /events requests (combined) per second, per client address")
+	perIPBurst = flag.Int("per_ip_burst", 5,
+		"Number of /search and /events requests a client address may burst above -per_ip_qps")
+	maxConcurrentQueries = flag.Int("max_concurrent_queries", 20,
+		"Maximum number of backend queries that may be in flight at once")
+	trustedProxyHeader = flag.String("trusted_proxy_header", "",
+		"If set (e.g. X-Forwarded-For), the client address for rate limiting "+
+			"is taken from this header instead of the TCP connection's remote "+
+			"address. Only set this behind a trusted reverse proxy")
+	rateLimiterIdleTTL = flag.Duration("rate_limiter_idle_ttl", 10*time.Minute,
+		"How long a client address' rate limiter is kept after its last "+
+			"request before being swept, to bound memory use")
+	querySlotTTL = flag.Duration("query_slot_ttl", 10*time.Minute,
+		"How long ensureQuerySlot waits for queryCompletedFunc to report a "+
+			"query done before giving up on it and releasing the slot anyway, "+
+			"so a hung backend query cannot permanently consume one of the "+
+			"-max_concurrent_queries slots")
+)
+
+// ipRateLimiter hands out one token-bucket rate.Limiter per client address,
+// creating it lazily on first use. lastSeen lets sweep reclaim limiters for
+// addresses that haven't made a request in a while, so that an attacker
+// rotating source addresses (or spoofed X-Forwarded-For values) can't grow
+// limiters without bound.
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	lastSeen map[string]time.Time
+}
+
+func newIPRateLimiter() *ipRateLimiter {
+	return &ipRateLimiter{
+		limiters: make(map[string]*rate.Limiter),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (l *ipRateLimiter) allow(addr string) bool {
+	l.mu.Lock()
+	limiter, ok := l.limiters[addr]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(*perIPQPS), *perIPBurst)
+		l.limiters[addr] = limiter
+	}
+	l.lastSeen[addr] = time.Now()
+	l.mu.Unlock()
+	return limiter.Allow()
+}
+
+// sweep drops limiters that haven't been used within idleTTL.
+func (l *ipRateLimiter) sweep(idleTTL time.Duration) {
+	cutoff := time.Now().Add(-idleTTL)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for addr, seen := range l.lastSeen {
+		if seen.Before(cutoff) {
+			delete(l.limiters, addr)
+			delete(l.lastSeen, addr)
+		}
+	}
+}
+
+var ipLimiter = newIPRateLimiter()
+
+// startRateLimiterJanitor periodically sweeps idle per-address limiters out
+// of ipLimiter so memory use stays bounded regardless of how many distinct
+// client addresses have ever made a request.
+func startRateLimiterJanitor() {
+	go func() {
+		for {
+			time.Sleep(*rateLimiterIdleTTL / 10)
+			ipLimiter.sweep(*rateLimiterIdleTTL)
+		}
+	}()
+}
+
+// clientIP returns the address a request should be rate-limited under,
+// honoring -trusted_proxy_header when configured.
+func clientIP(r *http.Request) string {
+	if *trustedProxyHeader != "" {
+		if v := r.Header.Get(*trustedProxyHeader); v != "" {
+			// X-Forwarded-For may list multiple hops; the client is the first.
+			return strings.TrimSpace(strings.Split(v, ",")[0])
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+var (
+	querySlotsOnce sync.Once
+	querySlots     chan struct{}
+)
+
+// acquireQuerySlot reserves one of -max_concurrent_queries global slots,
+// returning false if none are currently free.
+func acquireQuerySlot() bool {
+	querySlotsOnce.Do(func() {
+		querySlots = make(chan struct{}, *maxConcurrentQueries)
+	})
+	select {
+	case querySlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseQuerySlot() {
+	select {
+	case <-querySlots:
+	default:
+	}
+}
+
+// inFlightQueries tracks which queryids currently hold a global query slot,
+// so that ensureQuerySlot acquires at most one slot per queryid no matter
+// how many concurrent requests are waiting on it.
+var (
+	inFlightMu      sync.Mutex
+	inFlightQueries = make(map[string]bool)
+)
+
+// queryCompletedFunc indirects to queryCompleted so tests can stub it out
+// without a real backend query ever completing.
+var queryCompletedFunc = queryCompleted
+
+// ensureQuerySlot reserves a global query slot for queryid and holds it for
+// the lifetime of the backend query, not just for the HTTP handler that
+// happened to trigger it (which returns as soon as the placeholder page is
+// rendered). It returns false if no slot is available, in which case the
+// caller should respond with 429. If a slot is already held for queryid
+// (another request for the same query got there first), it returns true
+// without acquiring a second one.
+//
+// A backend query that hangs or crashes before ever flipping
+// queryCompleted (and, since such a query may never get an on-disk
+// directory either, may never be reclaimed by pruneOldQueries) would
+// otherwise hold its slot and watcher goroutine forever, permanently
+// shrinking -max_concurrent_queries by one per stuck query. -query_slot_ttl
+// bounds that: past the deadline, the slot is released and the
+// inFlightQueries entry dropped regardless of queryCompletedFunc, mirroring
+// ensurePump's pumpIdleTTL escape hatch in events.go.
+func ensureQuerySlot(queryid string) bool {
+	inFlightMu.Lock()
+	if inFlightQueries[queryid] {
+		inFlightMu.Unlock()
+		return true
+	}
+	if !acquireQuerySlot() {
+		inFlightMu.Unlock()
+		return false
+	}
+	inFlightQueries[queryid] = true
+	inFlightMu.Unlock()
+
+	go func() {
+		deadline := time.Now().Add(*querySlotTTL)
+		for !queryCompletedFunc(queryid) {
+			if time.Now().After(deadline) {
+				log.Printf("ensureQuerySlot(%q): giving up after %s with no completion, releasing slot", queryid, *querySlotTTL)
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		inFlightMu.Lock()
+		delete(inFlightQueries, queryid)
+		releaseQuerySlot()
+		inFlightMu.Unlock()
+	}()
+	return true
+}
+
+// tooManyRequests responds with 429 and a Retry-After hint, used both for
+// per-IP rate limiting and for the global concurrent-query cap.
+func tooManyRequests(w http.ResponseWriter, message string) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, message, http.StatusTooManyRequests)
+}
@@ -0,0 +1,163 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiterAllowBurst(t *testing.T) {
+	oldQPS, oldBurst := *perIPQPS, *perIPBurst
+	*perIPQPS, *perIPBurst = 1.0, 3
+	defer func() { *perIPQPS, *perIPBurst = oldQPS, oldBurst }()
+
+	l := newIPRateLimiter()
+	for i := 0; i < 3; i++ {
+		if !l.allow("1.2.3.4") {
+			t.Fatalf("request %d within burst was denied", i)
+		}
+	}
+	if l.allow("1.2.3.4") {
+		t.Errorf("request beyond burst should have been denied")
+	}
+	if !l.allow("5.6.7.8") {
+		t.Errorf("a different address should have its own limiter")
+	}
+}
+
+func TestIPRateLimiterSweep(t *testing.T) {
+	l := newIPRateLimiter()
+	l.allow("1.2.3.4")
+
+	l.mu.Lock()
+	l.lastSeen["1.2.3.4"] = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+
+	l.sweep(time.Minute)
+
+	l.mu.Lock()
+	_, ok := l.limiters["1.2.3.4"]
+	l.mu.Unlock()
+	if ok {
+		t.Errorf("idle limiter should have been swept")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	old := *trustedProxyHeader
+	defer func() { *trustedProxyHeader = old }()
+
+	*trustedProxyHeader = ""
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	if got := clientIP(r); got != "10.0.0.1" {
+		t.Errorf("clientIP() = %q, want 10.0.0.1", got)
+	}
+
+	*trustedProxyHeader = "X-Forwarded-For"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+	if got := clientIP(r); got != "203.0.113.5" {
+		t.Errorf("clientIP() with trusted proxy header = %q, want 203.0.113.5", got)
+	}
+}
+
+func TestAcquireReleaseQuerySlot(t *testing.T) {
+	old := *maxConcurrentQueries
+	*maxConcurrentQueries = 1
+	defer func() { *maxConcurrentQueries = old }()
+	querySlotsOnce = sync.Once{}
+	querySlots = nil
+
+	if !acquireQuerySlot() {
+		t.Fatalf("first acquire should succeed")
+	}
+	if acquireQuerySlot() {
+		t.Fatalf("second acquire should fail, slot is exhausted")
+	}
+	releaseQuerySlot()
+	if !acquireQuerySlot() {
+		t.Fatalf("acquire after release should succeed")
+	}
+	releaseQuerySlot()
+}
+
+func TestEnsureQuerySlotSharedAcrossConcurrentRequests(t *testing.T) {
+	old := *maxConcurrentQueries
+	*maxConcurrentQueries = 1
+	defer func() { *maxConcurrentQueries = old }()
+	querySlotsOnce = sync.Once{}
+	querySlots = nil
+	inFlightMu.Lock()
+	inFlightQueries = make(map[string]bool)
+	inFlightMu.Unlock()
+
+	completed := make(map[string]bool)
+	origCompleted := queryCompletedFunc
+	queryCompletedFunc = func(queryid string) bool { return completed[queryid] }
+	defer func() { queryCompletedFunc = origCompleted }()
+
+	if !ensureQuerySlot("qid") {
+		t.Fatalf("first ensureQuerySlot should acquire the only slot")
+	}
+	// A second request for the *same* queryid must not need a second slot.
+	if !ensureQuerySlot("qid") {
+		t.Fatalf("ensureQuerySlot for an in-flight queryid should succeed without a new slot")
+	}
+	// A different queryid has no slots left.
+	if ensureQuerySlot("other") {
+		t.Fatalf("ensureQuerySlot for a different queryid should fail, no slots left")
+	}
+
+	completed["qid"] = true
+	deadline := time.Now().Add(2 * time.Second)
+	acquired := acquireQuerySlot()
+	for !acquired && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		acquired = acquireQuerySlot()
+	}
+	if !acquired {
+		t.Fatalf("slot was not released after queryCompleted became true")
+	}
+	releaseQuerySlot()
+}
+
+func TestEnsureQuerySlotReleasedAfterTTLWhenQueryNeverCompletes(t *testing.T) {
+	old := *maxConcurrentQueries
+	*maxConcurrentQueries = 1
+	defer func() { *maxConcurrentQueries = old }()
+	oldTTL := *querySlotTTL
+	*querySlotTTL = 20 * time.Millisecond
+	defer func() { *querySlotTTL = oldTTL }()
+	querySlotsOnce = sync.Once{}
+	querySlots = nil
+	inFlightMu.Lock()
+	inFlightQueries = make(map[string]bool)
+	inFlightMu.Unlock()
+
+	origCompleted := queryCompletedFunc
+	queryCompletedFunc = func(queryid string) bool { return false }
+	defer func() { queryCompletedFunc = origCompleted }()
+
+	if !ensureQuerySlot("stuck") {
+		t.Fatalf("first ensureQuerySlot should acquire the only slot")
+	}
+
+	// The backend query never completes, but the slot must still be freed
+	// once -query_slot_ttl elapses, instead of being held forever.
+	deadline := time.Now().Add(2 * time.Second)
+	for acquireQuerySlot() == false && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !acquireQuerySlot() {
+		t.Fatalf("slot was not released after query_slot_ttl elapsed")
+	}
+	releaseQuerySlot()
+
+	inFlightMu.Lock()
+	_, stillTracked := inFlightQueries["stuck"]
+	inFlightMu.Unlock()
+	if stillTracked {
+		t.Errorf("inFlightQueries should have been cleared for a TTL-expired queryid")
+	}
+}
@@ -0,0 +1,247 @@
+// vim:ts=4:sw=4:noexpandtab
+// resultcache memoizes decoded result pages in memory, coalesces concurrent
+// requests for the same page and reaps query directories under
+// queryResultsPath once they exceed -query_results_ttl. Without it, every
+// request for an already-computed page re-reads and re-decodes page_%d.json
+// from disk, and query directories accumulate forever.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var queryResultsTTL = flag.Duration("query_results_ttl",
+	30*time.Minute,
+	"How long query result directories are kept on disk (and in the page "+
+		"cache) before the janitor deletes them")
+
+// resultPageCacheCapacity bounds how many decoded pages are kept in memory
+// at once, across all queries.
+const resultPageCacheCapacity = 1024
+
+// pageKey identifies a single decoded results page within a query.
+type pageKey struct {
+	queryid string
+	page    int
+}
+
+// resultPageCache is a simple LRU cache (keyed by pageKey) for decoded
+// []Result pages, avoiding repeated disk reads and JSON decoding for hot
+// queries.
+type resultPageCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[pageKey]*list.Element
+}
+
+type resultPageCacheEntry struct {
+	key     pageKey
+	results []Result
+}
+
+func newResultPageCache(capacity int) *resultPageCache {
+	return &resultPageCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[pageKey]*list.Element),
+	}
+}
+
+func (c *resultPageCache) get(key pageKey) ([]Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*resultPageCacheEntry).results, true
+}
+
+func (c *resultPageCache) add(key pageKey, results []Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*resultPageCacheEntry).results = results
+		return
+	}
+	elem := c.ll.PushFront(&resultPageCacheEntry{key: key, results: results})
+	c.items[key] = elem
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*resultPageCacheEntry).key)
+	}
+}
+
+// evict drops every cached page belonging to queryid, used by the janitor
+// once a query directory has been deleted from disk.
+func (c *resultPageCache) evict(queryid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.items {
+		if key.queryid == queryid {
+			c.ll.Remove(elem)
+			delete(c.items, key)
+		}
+	}
+}
+
+var pageCache = newResultPageCache(resultPageCacheCapacity)
+
+// pageCall tracks a single in-flight load of a results page so that
+// concurrent requests for the same page share one disk read instead of
+// racing each other.
+type pageCall struct {
+	wg      sync.WaitGroup
+	results []Result
+	err     error
+}
+
+// pageLoadGroup coalesces concurrent loadResultsPage calls for the same
+// pageKey, à la singleflight.
+type pageLoadGroup struct {
+	mu    sync.Mutex
+	calls map[pageKey]*pageCall
+}
+
+var loadGroup = pageLoadGroup{calls: make(map[pageKey]*pageCall)}
+
+func (g *pageLoadGroup) do(key pageKey, fn func() ([]Result, error)) ([]Result, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.results, c.err
+	}
+	c := &pageCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.results, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return c.results, c.err
+}
+
+// loadResultsPage returns the decoded results for queryid/page, consulting
+// pageCache first and falling back to disk (coalesced via loadGroup) on a
+// cache miss.
+func loadResultsPage(queryid string, page int) ([]Result, error) {
+	key := pageKey{queryid: queryid, page: page}
+	if results, ok := pageCache.get(key); ok {
+		return results, nil
+	}
+
+	results, err := loadGroup.do(key, func() ([]Result, error) {
+		name := filepath.Join(*queryResultsPath, queryid, fmt.Sprintf("page_%d.json", page))
+		resultsFile, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer resultsFile.Close()
+
+		var results []Result
+		if err := json.NewDecoder(resultsFile).Decode(&results); err != nil {
+			return nil, err
+		}
+		return results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pageCache.add(key, results)
+	return results, nil
+}
+
+// queryStartGroup coalesces concurrent first-time requests for a queryid so
+// that maybeStartQuery is only ever called once per query, instead of
+// racing the backend into starting the same query twice.
+var queryStartGroup = struct {
+	mu      sync.Mutex
+	started map[string]bool
+}{started: make(map[string]bool)}
+
+// maybeStartQueryFunc indirects to maybeStartQuery so tests can stub it out
+// without actually starting a backend query.
+var maybeStartQueryFunc = maybeStartQuery
+
+// ensureQueryStarted calls maybeStartQuery for queryid at most once. Search
+// calls this instead of maybeStartQuery directly so that the "two
+// concurrent requests for the same queryid share one backend query"
+// guarantee holds at the query-start layer, not just for page reads.
+func ensureQueryStarted(queryid, src, q string) {
+	queryStartGroup.mu.Lock()
+	if queryStartGroup.started[queryid] {
+		queryStartGroup.mu.Unlock()
+		return
+	}
+	queryStartGroup.started[queryid] = true
+	queryStartGroup.mu.Unlock()
+
+	maybeStartQueryFunc(queryid, src, q)
+}
+
+// forgetQueryStart drops the started-bookkeeping for queryid, used by the
+// janitor once a query directory has been reaped so queryStartGroup.started
+// doesn't grow by one entry per query forever.
+func forgetQueryStart(queryid string) {
+	queryStartGroup.mu.Lock()
+	delete(queryStartGroup.started, queryid)
+	queryStartGroup.mu.Unlock()
+}
+
+// startResultJanitor periodically deletes query result directories under
+// queryResultsPath that have not been modified within *queryResultsTTL, and
+// evicts any pages for them that are still in pageCache.
+func startResultJanitor(queryResultsPath string) {
+	go func() {
+		for {
+			time.Sleep(*queryResultsTTL / 10)
+			pruneOldQueries(queryResultsPath, *queryResultsTTL)
+		}
+	}()
+}
+
+func pruneOldQueries(root string, ttl time.Duration) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		log.Printf("resultcache: could not list %q: %v\n", root, err)
+		return
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.ModTime().After(cutoff) {
+			continue
+		}
+		queryid := entry.Name()
+		if err := os.RemoveAll(filepath.Join(root, queryid)); err != nil {
+			log.Printf("resultcache: could not remove %q: %v\n", queryid, err)
+			continue
+		}
+		pageCache.evict(queryid)
+		broadcaster.forget(queryid)
+		forgetQueryStart(queryid)
+	}
+}
@@ -0,0 +1,144 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultPageCacheGetAdd(t *testing.T) {
+	c := newResultPageCache(2)
+
+	key := pageKey{queryid: "abc", page: 0}
+	if _, ok := c.get(key); ok {
+		t.Fatalf("get on empty cache returned ok=true")
+	}
+
+	c.add(key, []Result{{Path: "foo_1/a.c"}})
+	results, ok := c.get(key)
+	if !ok || len(results) != 1 {
+		t.Fatalf("get() = %v, %v, want the just-added entry", results, ok)
+	}
+}
+
+func TestResultPageCacheEvictsLRU(t *testing.T) {
+	c := newResultPageCache(2)
+
+	k1 := pageKey{queryid: "q1", page: 0}
+	k2 := pageKey{queryid: "q2", page: 0}
+	k3 := pageKey{queryid: "q3", page: 0}
+
+	c.add(k1, []Result{{Path: "q1_1/a.c"}})
+	c.add(k2, []Result{{Path: "q2_1/a.c"}})
+	// Touch k1 so it is no longer the least-recently-used entry.
+	c.get(k1)
+	c.add(k3, []Result{{Path: "q3_1/a.c"}})
+
+	if _, ok := c.get(k2); ok {
+		t.Errorf("k2 should have been evicted as the LRU entry")
+	}
+	if _, ok := c.get(k1); !ok {
+		t.Errorf("k1 should still be cached, it was touched before k3 was added")
+	}
+	if _, ok := c.get(k3); !ok {
+		t.Errorf("k3 should still be cached, it was just added")
+	}
+}
+
+func TestResultPageCacheEvictByQueryid(t *testing.T) {
+	c := newResultPageCache(10)
+
+	c.add(pageKey{queryid: "q1", page: 0}, []Result{{Path: "q1_1/a.c"}})
+	c.add(pageKey{queryid: "q1", page: 1}, []Result{{Path: "q1_1/b.c"}})
+	c.add(pageKey{queryid: "q2", page: 0}, []Result{{Path: "q2_1/a.c"}})
+
+	c.evict("q1")
+
+	if _, ok := c.get(pageKey{queryid: "q1", page: 0}); ok {
+		t.Errorf("q1 page 0 should have been evicted")
+	}
+	if _, ok := c.get(pageKey{queryid: "q1", page: 1}); ok {
+		t.Errorf("q1 page 1 should have been evicted")
+	}
+	if _, ok := c.get(pageKey{queryid: "q2", page: 0}); !ok {
+		t.Errorf("q2 page 0 should be unaffected by evicting q1")
+	}
+}
+
+func TestEnsureQueryStartedCallsOnce(t *testing.T) {
+	queryStartGroup.mu.Lock()
+	queryStartGroup.started = make(map[string]bool)
+	queryStartGroup.mu.Unlock()
+
+	calls := 0
+	orig := maybeStartQueryFunc
+	maybeStartQueryFunc = func(queryid, src, q string) { calls++ }
+	defer func() { maybeStartQueryFunc = orig }()
+
+	ensureQueryStarted("qid", "src", "q=foo")
+	ensureQueryStarted("qid", "src", "q=foo")
+	ensureQueryStarted("qid", "src", "q=foo")
+
+	if calls != 1 {
+		t.Errorf("maybeStartQuery called %d times, want 1", calls)
+	}
+
+	forgetQueryStart("qid")
+	ensureQueryStarted("qid", "src", "q=foo")
+	if calls != 2 {
+		t.Errorf("maybeStartQuery called %d times after forgetQueryStart, want 2", calls)
+	}
+}
+
+func TestPruneOldQueries(t *testing.T) {
+	root := t.TempDir()
+
+	oldDir := filepath.Join(root, "oldqueryid")
+	if err := os.MkdirAll(oldDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	newDir := filepath.Join(root, "newqueryid")
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(oldDir, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	pageCache.add(pageKey{queryid: "oldqueryid", page: 0}, []Result{{Path: "old_1/a.c"}})
+	pageCache.add(pageKey{queryid: "newqueryid", page: 0}, []Result{{Path: "new_1/a.c"}})
+	queryStartGroup.mu.Lock()
+	queryStartGroup.started["oldqueryid"] = true
+	queryStartGroup.started["newqueryid"] = true
+	queryStartGroup.mu.Unlock()
+
+	pruneOldQueries(root, 30*time.Minute)
+
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("oldDir should have been removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(newDir); err != nil {
+		t.Errorf("newDir should still exist, stat err = %v", err)
+	}
+	if _, ok := pageCache.get(pageKey{queryid: "oldqueryid", page: 0}); ok {
+		t.Errorf("oldqueryid's pages should have been evicted from pageCache")
+	}
+	if _, ok := pageCache.get(pageKey{queryid: "newqueryid", page: 0}); !ok {
+		t.Errorf("newqueryid's pages should still be in pageCache")
+	}
+
+	queryStartGroup.mu.Lock()
+	_, oldStarted := queryStartGroup.started["oldqueryid"]
+	_, newStarted := queryStartGroup.started["newqueryid"]
+	queryStartGroup.mu.Unlock()
+	if oldStarted {
+		t.Errorf("oldqueryid should have been forgotten from queryStartGroup")
+	}
+	if !newStarted {
+		t.Errorf("newqueryid should still be tracked in queryStartGroup")
+	}
+}
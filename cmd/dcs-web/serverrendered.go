@@ -85,9 +85,151 @@ func updatePagination(currentpage int, resultpages int, baseurl string) string {
 	return result
 }
 
+// XXX: Using a dcsregexp.Match anonymous struct member doesn’t work, because
+// we need to assign to the members to get the data from Result over into
+// HalfRenderedResult.
+type HalfRenderedResult struct {
+	Path          string
+	Line          int
+	PathRank      float32
+	Ranking       float32
+	SourcePackage string
+	RelativePath  string
+	Context       template.HTML
+}
+
+// buildHalfRendered converts decoded disk results into the representation
+// results.html (and the perpkg grouping below) render from.
+func buildHalfRendered(results []Result) []HalfRenderedResult {
+	halfrendered := make([]HalfRenderedResult, len(results))
+	for idx, result := range results {
+		var context []string
+		context = maybeAppendContext(context, result.Ctxp2)
+		context = maybeAppendContext(context, result.Ctxp1)
+		context = append(context, "<strong>"+result.Context+"</strong>")
+		context = maybeAppendContext(context, result.Ctxn1)
+		context = maybeAppendContext(context, result.Ctxn2)
+
+		sourcePackage, relativePath := splitPath(result.Path)
+
+		halfrendered[idx] = HalfRenderedResult{
+			Path:          result.Path,
+			Line:          result.Line,
+			PathRank:      result.PathRank,
+			Ranking:       result.Ranking,
+			SourcePackage: sourcePackage,
+			RelativePath:  relativePath,
+			Context:       template.HTML(strings.Join(context, "<br>")),
+		}
+	}
+	return halfrendered
+}
+
+// loadAllResults loads and concatenates every results page of queryid (pages
+// 0..resultPages-1), via the page cache from resultcache.go so that repeated
+// perpkg= requests don't re-decode every page from disk each time.
+func loadAllResults(queryid string, resultPages int) ([]Result, error) {
+	var all []Result
+	for page := 0; page < resultPages; page++ {
+		pageResults, err := loadResultsPage(queryid, page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, pageResults...)
+	}
+	return all, nil
+}
+
+// defaultPerPkgLimit is the number of hits shown per source package when no
+// explicit limit is given (perpkg=1).
+const defaultPerPkgLimit = 5
+
+// packageGroupsPerPage bounds how many source packages are rendered on a
+// single perpkg= results page.
+const packageGroupsPerPage = 10
+
+// PackageGroup bundles the (capped) hits belonging to one source package for
+// perpkg= rendering.
+type PackageGroup struct {
+	SourcePackage string
+	Results       []HalfRenderedResult
+}
+
+// parsePerPkg interprets the perpkg= form value. perpkg=1 enables grouping
+// with the default per-package limit, while perpkg=<N> enables grouping and
+// caps each package to N hits.
+func parsePerPkg(r *http.Request) (enabled bool, limit int) {
+	v := r.Form.Get("perpkg")
+	if v == "" {
+		return false, 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 1 {
+		return true, defaultPerPkgLimit
+	}
+	return true, n
+}
+
+// groupByPackage groups results by SourcePackage, preserving the canonical
+// ordering given in order (as read from packages.json) and capping each
+// group to at most limit results.
+func groupByPackage(results []HalfRenderedResult, order []string, limit int) []PackageGroup {
+	byPkg := make(map[string][]HalfRenderedResult)
+	for _, result := range results {
+		if limit > 0 && len(byPkg[result.SourcePackage]) >= limit {
+			continue
+		}
+		byPkg[result.SourcePackage] = append(byPkg[result.SourcePackage], result)
+	}
+
+	groups := make([]PackageGroup, 0, len(byPkg))
+	seen := make(map[string]bool)
+	for _, pkg := range order {
+		if hits, ok := byPkg[pkg]; ok {
+			groups = append(groups, PackageGroup{SourcePackage: pkg, Results: hits})
+			seen[pkg] = true
+		}
+	}
+	// Packages that are present in the results but missing from the
+	// canonical order (shouldn’t normally happen) are appended at the end
+	// so that no hits are silently dropped.
+	for pkg, hits := range byPkg {
+		if !seen[pkg] {
+			groups = append(groups, PackageGroup{SourcePackage: pkg, Results: hits})
+		}
+	}
+	return groups
+}
+
+// paginatePackages slices groups into the requested page of size
+// packageGroupsPerPage, returning the groups to render and the total number
+// of package pages.
+func paginatePackages(groups []PackageGroup, page int) ([]PackageGroup, int) {
+	resultPages := (len(groups) + packageGroupsPerPage - 1) / packageGroupsPerPage
+	if resultPages == 0 {
+		resultPages = 1
+	}
+	start := page * packageGroupsPerPage
+	end := start + packageGroupsPerPage
+	if start < 0 {
+		start = 0
+	}
+	if start > len(groups) {
+		start = len(groups)
+	}
+	if end < start {
+		end = start
+	}
+	if end > len(groups) {
+		end = len(groups)
+	}
+	return groups[start:end], resultPages
+}
+
 // q= search term
 // page= page number
-// TODO: perpkg= per-package grouping
+// perpkg= per-package grouping (1 for the default limit, or a number of
+// hits to keep per source package)
 func Search(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Could not parse form data", http.StatusInternalServerError)
@@ -100,6 +242,11 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !ipLimiter.allow(clientIP(r)) {
+		tooManyRequests(w, "Rate limit exceeded, please slow down")
+		return
+	}
+
 	// We encode a URL that contains _only_ the q parameter.
 	q := url.Values{"q": []string{r.Form.Get("q")}}.Encode()
 
@@ -108,7 +255,7 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		pageStr = "0"
 	}
 	page, err := strconv.Atoi(pageStr)
-	if err != nil {
+	if err != nil || page < 0 {
 		http.Error(w, "Invalid page parameter", http.StatusBadRequest)
 		return
 	}
@@ -122,10 +269,32 @@ func Search(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("getquery(%q, %q, %q)\n", queryid, src, q)
 
-	maybeStartQuery(queryid, src, q)
+	format := determineFormat(r)
+
+	if !queryCompleted(queryid) {
+		// Held for the backend query's full lifetime (released in the
+		// background once queryCompleted(queryid) is true), not just for
+		// this handler's lifetime, so -max_concurrent_queries actually
+		// bounds in-flight backend queries rather than handler entries.
+		if !ensureQuerySlot(queryid) {
+			tooManyRequests(w, "Too many concurrent queries, please retry shortly")
+			return
+		}
+	}
+
+	// ensureQueryStarted (not maybeStartQuery directly) so that two
+	// concurrent requests for a brand-new queryid share one backend query
+	// instead of both racing to start it.
+	ensureQueryStarted(queryid, src, q)
 	if !queryCompleted(queryid) {
+		ensurePump(queryid)
+		if format != "html" {
+			writeFormattedResults(w, format, r.Form.Get("q"), queryid, page, 0, false, nil)
+			return
+		}
 		if err := common.Templates.ExecuteTemplate(w, "placeholder.html", map[string]interface{}{
 			"q":       r.Form.Get("q"),
+			"queryid": queryid,
 			"version": common.Version,
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,58 +306,28 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[%s] server-rendering page %d\n", queryid, page)
 
 	dir := filepath.Join(*queryResultsPath, queryid)
-	name := filepath.Join(dir, fmt.Sprintf("page_%d.json", page))
-	resultsFile, err := os.Open(name)
-	if err != nil {
-		http.Error(w,
-			fmt.Sprintf("Could not open results file on disk: %v", err),
-			http.StatusInternalServerError)
-		return
-	}
-	defer resultsFile.Close()
 
+	perpkg, limit := parsePerPkg(r)
+
+	// With perpkg= (HTML only), page indexes package pages, so the match page
+	// of the same number is not needed and may not even exist.
 	var results []Result
-	if err := json.NewDecoder(resultsFile).Decode(&results); err != nil {
-		http.Error(w,
-			fmt.Sprintf("Could not parse results from disk: %v", err),
-			http.StatusInternalServerError)
-		return
+	if !perpkg || format != "html" {
+		results, err = loadResultsPage(queryid, page)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("Could not load results page from disk: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// XXX: Using a dcsregexp.Match anonymous struct member doesn’t work,
-	// because we need to assign to the members to get the data from Result
-	// over into HalfRenderedResult.
-	type HalfRenderedResult struct {
-		Path          string
-		Line          int
-		PathRank      float32
-		Ranking       float32
-		SourcePackage string
-		RelativePath  string
-		Context       template.HTML
+	if format != "html" {
+		writeFormattedResults(w, format, r.Form.Get("q"), queryid, page, state[queryid].resultPages, true, results)
+		return
 	}
 
-	halfrendered := make([]HalfRenderedResult, len(results))
-	for idx, result := range results {
-		var context []string
-		context = maybeAppendContext(context, result.Ctxp2)
-		context = maybeAppendContext(context, result.Ctxp1)
-		context = append(context, "<strong>"+result.Context+"</strong>")
-		context = maybeAppendContext(context, result.Ctxn1)
-		context = maybeAppendContext(context, result.Ctxn2)
-
-		sourcePackage, relativePath := splitPath(result.Path)
-
-		halfrendered[idx] = HalfRenderedResult{
-			Path:          result.Path,
-			Line:          result.Line,
-			PathRank:      result.PathRank,
-			Ranking:       result.Ranking,
-			SourcePackage: sourcePackage,
-			RelativePath:  relativePath,
-			Context:       template.HTML(strings.Join(context, "<br>")),
-		}
-	}
+	halfrendered := buildHalfRendered(results)
 
 	packagesFile, err := os.Open(filepath.Join(dir, "packages.json"))
 	if err != nil {
@@ -214,9 +353,43 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	basequery.Del("page")
 	baseurl := r.URL
 	baseurl.RawQuery = basequery.Encode()
+
+	if perpkg {
+		// Group across the whole result set, not just this match-page: a
+		// single page_%d.json rarely holds more than a handful of distinct
+		// packages, which would make the per-package pagination below a
+		// no-op and defeat the point of perpkg (archive-wide coverage).
+		allResults, err := loadAllResults(queryid, state[queryid].resultPages)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("Could not load results from disk: %v", err),
+				http.StatusInternalServerError)
+			return
+		}
+		groups := groupByPackage(buildHalfRendered(allResults), packages.Packages, limit)
+		// page here indexes package pages, independent of the match-page
+		// index used for the non-perpkg results.html rendering below.
+		pageGroups, packagePages := paginatePackages(groups, page)
+		pagination := updatePagination(page, packagePages, baseurl.String())
+
+		if err := common.Templates.ExecuteTemplate(w, "results.html", map[string]interface{}{
+			"perpkg":     true,
+			"groups":     pageGroups,
+			"packages":   packages.Packages,
+			"pagination": template.HTML(pagination),
+			"q":          r.Form.Get("q"),
+			"version":    common.Version,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
 	pagination := updatePagination(page, state[queryid].resultPages, baseurl.String())
 
 	if err := common.Templates.ExecuteTemplate(w, "results.html", map[string]interface{}{
+		"perpkg":     false,
 		"results":    halfrendered,
 		"packages":   packages.Packages,
 		"pagination": template.HTML(pagination),
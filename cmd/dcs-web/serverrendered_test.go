@@ -0,0 +1,101 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestGroupByPackage(t *testing.T) {
+	results := []HalfRenderedResult{
+		{SourcePackage: "bash", Path: "bash_1/a.c"},
+		{SourcePackage: "bash", Path: "bash_1/b.c"},
+		{SourcePackage: "bash", Path: "bash_1/c.c"},
+		{SourcePackage: "coreutils", Path: "coreutils_1/a.c"},
+	}
+
+	groups := groupByPackage(results, []string{"coreutils", "bash"}, 2)
+
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	if groups[0].SourcePackage != "coreutils" {
+		t.Errorf("groups[0] = %q, want canonical order to put coreutils first", groups[0].SourcePackage)
+	}
+	if got := len(groups[1].Results); got != 2 {
+		t.Errorf("bash group has %d results, want capped to limit 2", got)
+	}
+}
+
+func TestGroupByPackagePackageMissingFromOrder(t *testing.T) {
+	results := []HalfRenderedResult{
+		{SourcePackage: "unlisted", Path: "unlisted_1/a.c"},
+	}
+
+	groups := groupByPackage(results, []string{"bash"}, 5)
+
+	if len(groups) != 1 || groups[0].SourcePackage != "unlisted" {
+		t.Errorf("expected the unlisted package's hits to still be returned, got %+v", groups)
+	}
+}
+
+func TestPaginatePackages(t *testing.T) {
+	groups := make([]PackageGroup, 25)
+	for i := range groups {
+		groups[i] = PackageGroup{SourcePackage: string(rune('a' + i))}
+	}
+
+	page, pages := paginatePackages(groups, 1)
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+	if len(page) != packageGroupsPerPage {
+		t.Errorf("len(page) = %d, want %d", len(page), packageGroupsPerPage)
+	}
+	if page[0].SourcePackage != groups[packageGroupsPerPage].SourcePackage {
+		t.Errorf("page 1 starts at %q, want %q", page[0].SourcePackage, groups[packageGroupsPerPage].SourcePackage)
+	}
+}
+
+// Regression test for a negative page= causing groups[start:end] to panic
+// with "slice bounds out of range" (start < 0, end == 0).
+func TestPaginatePackagesNegativePage(t *testing.T) {
+	groups := make([]PackageGroup, 5)
+
+	page, pages := paginatePackages(groups, -1)
+	if len(page) != 0 {
+		t.Errorf("len(page) = %d, want 0 for a negative page", len(page))
+	}
+	if pages != 1 {
+		t.Errorf("pages = %d, want 1", pages)
+	}
+}
+
+func TestParsePerPkg(t *testing.T) {
+	tests := []struct {
+		value       string
+		wantEnabled bool
+		wantLimit   int
+	}{
+		{"", false, 0},
+		{"1", true, defaultPerPkgLimit},
+		{"10", true, 10},
+		{"not-a-number", true, defaultPerPkgLimit},
+		{"-5", true, defaultPerPkgLimit},
+	}
+
+	for _, test := range tests {
+		form := url.Values{}
+		if test.value != "" {
+			form.Set("perpkg", test.value)
+		}
+		r := &http.Request{Form: form}
+
+		enabled, limit := parsePerPkg(r)
+		if enabled != test.wantEnabled || limit != test.wantLimit {
+			t.Errorf("parsePerPkg(perpkg=%q) = (%v, %d), want (%v, %d)",
+				test.value, enabled, limit, test.wantEnabled, test.wantLimit)
+		}
+	}
+}